@@ -1,14 +1,20 @@
 package checker
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/restic/restic"
 	"github.com/restic/restic/backend"
 	"github.com/restic/restic/debug"
+	"github.com/restic/restic/pack"
 	"github.com/restic/restic/repository"
 )
 
@@ -18,7 +24,7 @@ import (
 // A Checker only tests for internal errors within the data structures of the
 // repository (e.g. missing blobs), and needs a valid Repository to work on.
 type Checker struct {
-	packs    map[backend.ID]struct{}
+	packs    map[backend.ID][]backend.ID
 	blobs    map[backend.ID]struct{}
 	blobRefs struct {
 		sync.Mutex
@@ -27,30 +33,105 @@ type Checker struct {
 	indexes       map[backend.ID]*repository.Index
 	orphanedPacks backend.IDs
 
+	// verifiedTrees records, for every tree that has already passed
+	// checkTree without error, the blobs and subtrees it references. A
+	// Checker restored from a previous run's SaveState uses this to skip
+	// re-loading and re-validating a tree's structure (tree IDs are
+	// content-addressed, so the same ID always means the same content), while
+	// still recomputing blobRefs liveness from it every run.
+	verifiedTrees struct {
+		sync.Mutex
+		M map[backend.ID]treeContents
+	}
+
 	masterIndex *repository.Index
 
 	repo *repository.Repository
+
+	readDataWorkers int
+
+	// readDataBytesPerSecond caps the rate at which ReadData downloads pack
+	// data, in addition to readDataWorkers capping concurrency. 0 means
+	// unlimited. Accessed atomically since SetReadDataBandwidthLimit may be
+	// called while ReadData reads it to build readDataLimiter.
+	readDataBytesPerSecond int64
+
+	// readDataLimiter is the rateLimiter the current (or most recent)
+	// ReadData run's workers share, built once from readDataBytesPerSecond
+	// when ReadData starts so that concurrent workers draw from one bucket
+	// instead of each getting their own readDataBytesPerSecond allowance.
+	readDataLimiter *rateLimiter
+
+	// verifiedPacks records which packs ReadData has already verified
+	// without finding an error, so that a Checker restored from a previous
+	// run's SaveState doesn't re-download and re-decrypt them.
+	verifiedPacks struct {
+		sync.Mutex
+		M map[backend.ID]struct{}
+	}
+
+	// progress holds counters updated atomically by the various check
+	// workers so that Run can report a Progress snapshot without
+	// synchronizing with them directly.
+	progress struct {
+		treesChecked  uint64
+		packsChecked  uint64
+		blobsVerified uint64
+		bytesRead     uint64
+	}
 }
 
 // New returns a new checker which runs on repo.
 func New(repo *repository.Repository) *Checker {
 	c := &Checker{
-		packs:       make(map[backend.ID]struct{}),
-		blobs:       make(map[backend.ID]struct{}),
-		masterIndex: repository.NewIndex(),
-		indexes:     make(map[backend.ID]*repository.Index),
-		repo:        repo,
+		packs:           make(map[backend.ID][]backend.ID),
+		blobs:           make(map[backend.ID]struct{}),
+		masterIndex:     repository.NewIndex(),
+		indexes:         make(map[backend.ID]*repository.Index),
+		repo:            repo,
+		readDataWorkers: defaultParallelism,
 	}
 
 	c.blobRefs.M = make(map[backend.ID]uint)
+	c.verifiedPacks.M = make(map[backend.ID]struct{})
+	c.verifiedTrees.M = make(map[backend.ID]treeContents)
 
 	return c
 }
 
+// treeContents records the blobs and subtrees a tree references, as found by
+// a previous, successful run of checkTree.
+type treeContents struct {
+	Blobs    backend.IDs
+	Subtrees backend.IDs
+}
+
 const defaultParallelism = 40
 
-// LoadIndex loads all index files.
-func (c *Checker) LoadIndex() error {
+// SetReadDataWorkers sets the number of workers used by ReadData to download
+// and decrypt pack files concurrently. It defaults to defaultParallelism;
+// pass a lower number to cap the CPU and number of concurrent requests used
+// by a deep check run on a repository that's serving other requests at the
+// same time. See SetReadDataBandwidthLimit to cap the byte rate instead.
+func (c *Checker) SetReadDataWorkers(n int) {
+	if n <= 0 {
+		n = defaultParallelism
+	}
+
+	c.readDataWorkers = n
+}
+
+// SetReadDataBandwidthLimit caps the rate at which ReadData downloads pack
+// data to bytesPerSecond, on top of whatever concurrency
+// SetReadDataWorkers allows. A bytesPerSecond <= 0 removes the cap, which is
+// the default.
+func (c *Checker) SetReadDataBandwidthLimit(bytesPerSecond int64) {
+	atomic.StoreInt64(&c.readDataBytesPerSecond, bytesPerSecond)
+}
+
+// LoadIndex loads all index files. It returns ctx.Err() if ctx is cancelled
+// before it finishes.
+func (c *Checker) LoadIndex(ctx context.Context) error {
 	debug.Log("LoadIndex", "Start")
 	type indexRes struct {
 		Index *repository.Index
@@ -59,18 +140,18 @@ func (c *Checker) LoadIndex() error {
 
 	indexCh := make(chan indexRes)
 
-	worker := func(id backend.ID, done <-chan struct{}) error {
+	worker := func(ctx context.Context, id backend.ID) error {
 		debug.Log("LoadIndex", "worker got index %v", id)
-		idx, err := repository.LoadIndexWithDecoder(c.repo, id.String(), repository.DecodeIndex)
+		idx, err := repository.LoadIndexWithDecoder(ctx, c.repo, id.String(), repository.DecodeIndex)
 		if err == repository.ErrOldIndexFormat {
 			debug.Log("LoadIndex", "old index format found, converting")
 			fmt.Fprintf(os.Stderr, "convert index %v to new format\n", id.Str())
-			id, err = repository.ConvertIndex(c.repo, id)
+			id, err = repository.ConvertIndex(ctx, c.repo, id)
 			if err != nil {
 				return err
 			}
 
-			idx, err = repository.LoadIndexWithDecoder(c.repo, id.String(), repository.DecodeIndex)
+			idx, err = repository.LoadIndexWithDecoder(ctx, c.repo, id.String(), repository.DecodeIndex)
 		}
 
 		if err != nil {
@@ -79,7 +160,7 @@ func (c *Checker) LoadIndex() error {
 
 		select {
 		case indexCh <- indexRes{Index: idx, ID: id.String()}:
-		case <-done:
+		case <-ctx.Done():
 		}
 
 		return nil
@@ -89,14 +170,11 @@ func (c *Checker) LoadIndex() error {
 	go func() {
 		defer close(indexCh)
 		debug.Log("LoadIndex", "start loading indexes in parallel")
-		perr = repository.FilesInParallel(c.repo.Backend(), backend.Index, defaultParallelism,
+		perr = repository.FilesInParallel(ctx, c.repo.Backend(), backend.Index, defaultParallelism,
 			repository.ParallelWorkFuncParseID(worker))
 		debug.Log("LoadIndex", "loading indexes finished, error: %v", perr)
 	}()
 
-	done := make(chan struct{})
-	defer close(done)
-
 	for res := range indexCh {
 		debug.Log("LoadIndex", "process index %v", res.ID)
 		id, err := backend.ParseID(res.ID)
@@ -109,8 +187,8 @@ func (c *Checker) LoadIndex() error {
 
 		debug.Log("LoadIndex", "process blobs")
 		cnt := 0
-		for blob := range res.Index.Each(done) {
-			c.packs[blob.PackID] = struct{}{}
+		for blob := range res.Index.Each(ctx.Done()) {
+			c.packs[blob.PackID] = append(c.packs[blob.PackID], blob.ID)
 			c.blobs[blob.ID] = struct{}{}
 			c.blobRefs.M[blob.ID] = 0
 			cnt++
@@ -121,6 +199,10 @@ func (c *Checker) LoadIndex() error {
 
 	debug.Log("LoadIndex", "done, error %v", perr)
 
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
 	c.repo.SetIndex(c.masterIndex)
 
 	return perr
@@ -137,14 +219,28 @@ func (e PackError) Error() string {
 	return "pack " + e.ID.String() + ": " + e.Err.Error()
 }
 
-func packIDTester(repo *repository.Repository, inChan <-chan backend.ID, errChan chan<- error, wg *sync.WaitGroup, done <-chan struct{}) {
+// ContentError is returned by ReadData when the content of a pack does not
+// match what's recorded in the index: either a blob's plaintext doesn't hash
+// to the blob ID the index promised, or the pack's own header disagrees with
+// the blobs actually stored in it.
+type ContentError struct {
+	PackID backend.ID
+	BlobID backend.ID
+	Err    error
+}
+
+func (e ContentError) Error() string {
+	return "pack " + e.PackID.String() + ", blob " + e.BlobID.String() + ": " + e.Err.Error()
+}
+
+func (c *Checker) packIDTester(ctx context.Context, inChan <-chan backend.ID, errChan chan<- error, wg *sync.WaitGroup) {
 	debug.Log("Checker.testPackID", "worker start")
 	defer debug.Log("Checker.testPackID", "worker done")
 
 	defer wg.Done()
 
 	for id := range inChan {
-		ok, err := repo.Backend().Test(backend.Data, id.String())
+		ok, err := c.repo.Backend().Test(ctx, backend.Data, id.String())
 		if err != nil {
 			err = PackError{ID: id, Err: err}
 		} else {
@@ -153,10 +249,12 @@ func packIDTester(repo *repository.Repository, inChan <-chan backend.ID, errChan
 			}
 		}
 
+		atomic.AddUint64(&c.progress.packsChecked, 1)
+
 		if err != nil {
 			debug.Log("Checker.testPackID", "error checking for pack %s: %v", id.Str(), err)
 			select {
-			case <-done:
+			case <-ctx.Done():
 				return
 			case errChan <- err:
 			}
@@ -170,8 +268,8 @@ func packIDTester(repo *repository.Repository, inChan <-chan backend.ID, errChan
 
 // Packs checks that all packs referenced in the index are still available and
 // there are no packs that aren't in an index. errChan is closed after all
-// packs have been checked.
-func (c *Checker) Packs(errChan chan<- error, done <-chan struct{}) {
+// packs have been checked, or ctx is cancelled.
+func (c *Checker) Packs(ctx context.Context, errChan chan<- error) {
 	defer close(errChan)
 
 	debug.Log("Checker.Packs", "checking for %d packs", len(c.packs))
@@ -182,12 +280,18 @@ func (c *Checker) Packs(errChan chan<- error, done <-chan struct{}) {
 	IDChan := make(chan backend.ID)
 	for i := 0; i < defaultParallelism; i++ {
 		workerWG.Add(1)
-		go packIDTester(c.repo, IDChan, errChan, &workerWG, done)
+		go c.packIDTester(ctx, IDChan, errChan, &workerWG)
 	}
 
 	for id := range c.packs {
 		seenPacks[id] = struct{}{}
-		IDChan <- id
+		select {
+		case <-ctx.Done():
+			close(IDChan)
+			workerWG.Wait()
+			return
+		case IDChan <- id:
+		}
 	}
 	close(IDChan)
 
@@ -195,12 +299,12 @@ func (c *Checker) Packs(errChan chan<- error, done <-chan struct{}) {
 	workerWG.Wait()
 	debug.Log("Checker.Packs", "workers terminated")
 
-	for id := range c.repo.List(backend.Data, done) {
+	for id := range c.repo.List(ctx, backend.Data) {
 		debug.Log("Checker.Packs", "check data blob %v", id.Str())
 		if _, ok := seenPacks[id]; !ok {
 			c.orphanedPacks = append(c.orphanedPacks, id)
 			select {
-			case <-done:
+			case <-ctx.Done():
 				return
 			case errChan <- PackError{ID: id, Orphaned: true, Err: errors.New("not referenced in any index")}:
 			}
@@ -208,6 +312,139 @@ func (c *Checker) Packs(errChan chan<- error, done <-chan struct{}) {
 	}
 }
 
+func (c *Checker) readPackWorker(ctx context.Context, inChan <-chan backend.ID, errChan chan<- error, wg *sync.WaitGroup) {
+	debug.Log("Checker.readPackWorker", "worker start")
+	defer debug.Log("Checker.readPackWorker", "worker done")
+
+	defer wg.Done()
+
+	for id := range inChan {
+		for _, err := range c.checkPack(ctx, id) {
+			select {
+			case <-ctx.Done():
+				return
+			case errChan <- err:
+			}
+		}
+	}
+}
+
+// checkPack downloads the pack with the given ID, decrypts every blob in it
+// and verifies that the plaintext hashes to the blob ID recorded in the
+// pack's header. It also reports every blob the index places in this pack
+// that the pack's header doesn't list; blobs the header lists but the index
+// doesn't are not reported.
+func (c *Checker) checkPack(ctx context.Context, id backend.ID) (errs []error) {
+	c.verifiedPacks.Lock()
+	_, verified := c.verifiedPacks.M[id]
+	c.verifiedPacks.Unlock()
+	if verified {
+		debug.Log("Checker.checkPack", "pack %v already verified, skipping", id.Str())
+		return nil
+	}
+
+	debug.Log("Checker.checkPack", "checking pack %v", id.Str())
+
+	rd, err := c.repo.Backend().Get(ctx, backend.Data, id.String())
+	if err != nil {
+		return []error{PackError{ID: id, Err: err}}
+	}
+	defer rd.Close()
+
+	buf, err := ioutil.ReadAll(newRateLimitedReader(rd, c.readDataLimiter))
+	if err != nil {
+		return []error{PackError{ID: id, Err: err}}
+	}
+
+	entries, err := pack.List(c.repo.Key(), bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return []error{PackError{ID: id, Err: fmt.Errorf("unable to list pack contents: %v", err)}}
+	}
+
+	inPack := make(map[backend.ID]struct{}, len(entries))
+	for _, entry := range entries {
+		inPack[entry.ID] = struct{}{}
+
+		plaintext, err := c.repo.Key().Decrypt(nil, buf[entry.Offset:entry.Offset+entry.Length])
+		if err != nil {
+			errs = append(errs, ContentError{PackID: id, BlobID: entry.ID, Err: err})
+			continue
+		}
+
+		hash := sha256.Sum256(plaintext)
+		if !bytes.Equal(hash[:], entry.ID[:]) {
+			errs = append(errs, ContentError{PackID: id, BlobID: entry.ID,
+				Err: errors.New("blob data does not match hash in index")})
+		}
+	}
+
+	for _, blobID := range c.packs[id] {
+		if _, ok := inPack[blobID]; !ok {
+			errs = append(errs, ContentError{PackID: id, BlobID: blobID,
+				Err: errors.New("blob listed in index but not found in pack")})
+		}
+	}
+
+	atomic.AddUint64(&c.progress.blobsVerified, uint64(len(entries)))
+	atomic.AddUint64(&c.progress.bytesRead, uint64(len(buf)))
+
+	if len(errs) == 0 {
+		c.verifiedPacks.Lock()
+		c.verifiedPacks.M[id] = struct{}{}
+		c.verifiedPacks.Unlock()
+	}
+
+	return errs
+}
+
+// ReadData loads all data from the repository and checks the integrity of
+// the contents: for every pack it decrypts each blob and verifies that the
+// SHA-256 hash of the plaintext matches the blob ID recorded in the index,
+// and that the pack's header matches what's actually stored in the pack.
+// This is much more expensive than Packs(), which only checks that the pack
+// files are present, so it's meant to be run out-of-band; use
+// SetReadDataWorkers to cap how much CPU and concurrency it consumes, and
+// SetReadDataBandwidthLimit to cap how much bandwidth it consumes. errChan
+// is closed after all packs have been checked, or ctx is cancelled.
+func (c *Checker) ReadData(ctx context.Context, errChan chan<- error) {
+	defer close(errChan)
+
+	debug.Log("Checker.ReadData", "checking %d packs", len(c.packs))
+
+	workers := c.readDataWorkers
+	if workers <= 0 {
+		workers = defaultParallelism
+	}
+
+	// Built once, before any worker starts, so every worker's checkPack call
+	// draws from the same bucket instead of each getting its own
+	// readDataBytesPerSecond allowance.
+	c.readDataLimiter = newRateLimiter(atomic.LoadInt64(&c.readDataBytesPerSecond))
+
+	var workerWG sync.WaitGroup
+
+	IDChan := make(chan backend.ID)
+	for i := 0; i < workers; i++ {
+		workerWG.Add(1)
+		go c.readPackWorker(ctx, IDChan, errChan, &workerWG)
+	}
+
+	for id := range c.packs {
+		select {
+		case <-ctx.Done():
+			close(IDChan)
+			workerWG.Wait()
+			return
+		case IDChan <- id:
+		}
+	}
+	close(IDChan)
+
+	debug.Log("Checker.ReadData", "waiting for %d workers to terminate", workers)
+	workerWG.Wait()
+	debug.Log("Checker.ReadData", "workers terminated")
+}
+
 // Error is an error that occurred while checking a repository.
 type Error struct {
 	TreeID *backend.ID
@@ -230,23 +467,34 @@ func (e Error) Error() string {
 	return e.Err.Error()
 }
 
-func loadTreeFromSnapshot(repo *repository.Repository, id backend.ID) (backend.ID, error) {
-	sn, err := restic.LoadSnapshot(repo, id)
+// SnapshotError is returned when a snapshot can't be loaded, or doesn't
+// reference a tree at all.
+type SnapshotError struct {
+	ID  backend.ID
+	Err error
+}
+
+func (e SnapshotError) Error() string {
+	return "snapshot " + e.ID.String() + ": " + e.Err.Error()
+}
+
+func loadTreeFromSnapshot(ctx context.Context, repo *repository.Repository, id backend.ID) (backend.ID, error) {
+	sn, err := restic.LoadSnapshot(ctx, repo, id)
 	if err != nil {
 		debug.Log("Checker.loadTreeFromSnapshot", "error loading snapshot %v: %v", id.Str(), err)
-		return backend.ID{}, err
+		return backend.ID{}, SnapshotError{ID: id, Err: err}
 	}
 
 	if sn.Tree == nil {
 		debug.Log("Checker.loadTreeFromSnapshot", "snapshot %v has no tree", id.Str())
-		return backend.ID{}, fmt.Errorf("snapshot %v has no tree", id)
+		return backend.ID{}, SnapshotError{ID: id, Err: errors.New("snapshot has no tree")}
 	}
 
 	return *sn.Tree, nil
 }
 
 // loadSnapshotTreeIDs loads all snapshots from backend and returns the tree IDs.
-func loadSnapshotTreeIDs(repo *repository.Repository) (backend.IDs, []error) {
+func loadSnapshotTreeIDs(ctx context.Context, repo *repository.Repository) (backend.IDs, []error) {
 	var trees struct {
 		IDs backend.IDs
 		sync.Mutex
@@ -257,7 +505,7 @@ func loadSnapshotTreeIDs(repo *repository.Repository) (backend.IDs, []error) {
 		sync.Mutex
 	}
 
-	snapshotWorker := func(strID string, done <-chan struct{}) error {
+	snapshotWorker := func(ctx context.Context, strID string) error {
 		id, err := backend.ParseID(strID)
 		if err != nil {
 			return err
@@ -265,7 +513,7 @@ func loadSnapshotTreeIDs(repo *repository.Repository) (backend.IDs, []error) {
 
 		debug.Log("Checker.Snaphots", "load snapshot %v", id.Str())
 
-		treeID, err := loadTreeFromSnapshot(repo, id)
+		treeID, err := loadTreeFromSnapshot(ctx, repo, id)
 		if err != nil {
 			errs.Lock()
 			errs.errs = append(errs.errs, err)
@@ -281,7 +529,7 @@ func loadSnapshotTreeIDs(repo *repository.Repository) (backend.IDs, []error) {
 		return nil
 	}
 
-	err := repository.FilesInParallel(repo.Backend(), backend.Snapshot, defaultParallelism, snapshotWorker)
+	err := repository.FilesInParallel(ctx, repo.Backend(), backend.Snapshot, defaultParallelism, snapshotWorker)
 	if err != nil {
 		errs.errs = append(errs.errs, err)
 	}
@@ -303,12 +551,30 @@ type treeJob struct {
 	backend.ID
 	error
 	*restic.Tree
+
+	// cached is set instead of Tree when the tree's structure was already
+	// verified by a previous run (see Checker.cachedTree). checkTreeWorker
+	// trusts it without re-loading or re-validating the tree.
+	cached *treeContents
+}
+
+// subtrees returns the IDs of the job's subtrees, whether the job was loaded
+// fresh or came from the verified-tree cache.
+func (j treeJob) subtrees() backend.IDs {
+	if j.cached != nil {
+		return j.cached.Subtrees
+	}
+
+	return j.Tree.Subtrees()
 }
 
-// loadTreeWorker loads trees from repo and sends them to out.
-func loadTreeWorker(repo *repository.Repository,
+// loadTreeWorker loads trees from repo and sends them to out. A tree ID
+// already present in c.verifiedTrees is sent as a cached job without being
+// re-loaded from the repo, since tree IDs are content-addressed and the
+// tree's structure was already validated the run that populated the cache.
+func (c *Checker) loadTreeWorker(ctx context.Context,
 	in <-chan backend.ID, out chan<- treeJob,
-	done <-chan struct{}, wg *sync.WaitGroup) {
+	wg *sync.WaitGroup) {
 
 	defer func() {
 		debug.Log("checker.loadTreeWorker", "exiting")
@@ -324,7 +590,7 @@ func loadTreeWorker(repo *repository.Repository,
 	outCh = nil
 	for {
 		select {
-		case <-done:
+		case <-ctx.Done():
 			return
 
 		case treeID, ok := <-inCh:
@@ -333,9 +599,15 @@ func loadTreeWorker(repo *repository.Repository,
 			}
 			debug.Log("checker.loadTreeWorker", "load tree %v", treeID.Str())
 
-			tree, err := restic.LoadTree(repo, treeID)
-			debug.Log("checker.loadTreeWorker", "load tree %v (%v) returned err %v", tree, treeID.Str(), err)
-			job = treeJob{ID: treeID, error: err, Tree: tree}
+			if contents, ok := c.cachedTree(treeID); ok {
+				debug.Log("checker.loadTreeWorker", "tree %v already verified, using cache", treeID.Str())
+				job = treeJob{ID: treeID, cached: &contents}
+			} else {
+				tree, err := restic.LoadTree(ctx, c.repo, treeID)
+				debug.Log("checker.loadTreeWorker", "load tree %v (%v) returned err %v", tree, treeID.Str(), err)
+				job = treeJob{ID: treeID, error: err, Tree: tree}
+			}
+
 			outCh = out
 			inCh = nil
 
@@ -348,7 +620,7 @@ func loadTreeWorker(repo *repository.Repository,
 }
 
 // checkTreeWorker checks the trees received and sends out errors to errChan.
-func (c *Checker) checkTreeWorker(in <-chan treeJob, out chan<- TreeError, done <-chan struct{}, wg *sync.WaitGroup) {
+func (c *Checker) checkTreeWorker(ctx context.Context, in <-chan treeJob, out chan<- TreeError, wg *sync.WaitGroup) {
 	defer func() {
 		debug.Log("checker.checkTreeWorker", "exiting")
 		wg.Done()
@@ -363,7 +635,7 @@ func (c *Checker) checkTreeWorker(in <-chan treeJob, out chan<- TreeError, done
 	outCh = nil
 	for {
 		select {
-		case <-done:
+		case <-ctx.Done():
 			return
 
 		case job, ok := <-inCh:
@@ -385,9 +657,23 @@ func (c *Checker) checkTreeWorker(in <-chan treeJob, out chan<- TreeError, done
 				continue
 			}
 
+			atomic.AddUint64(&c.progress.treesChecked, 1)
+
 			debug.Log("checker.checkTreeWorker", "load tree %v", job.ID.Str())
 
-			errs := c.checkTree(job.ID, job.Tree)
+			var errs []error
+			if job.cached != nil {
+				// Structure was already verified by a previous run; only
+				// liveness needs to be recomputed, since it must reflect the
+				// current set of snapshots every run.
+				errs = c.recordLiveBlobs(job.ID, job.cached.Blobs)
+			} else {
+				errs = c.checkTree(job.ID, job.Tree)
+				if len(errs) == 0 {
+					c.rememberVerifiedTree(job.ID, job.Tree)
+				}
+			}
+
 			if len(errs) > 0 {
 				debug.Log("checker.checkTreeWorker", "checked tree %v: %v errors", job.ID.Str(), len(errs))
 				treeError = TreeError{ID: job.ID, Errors: errs}
@@ -403,7 +689,7 @@ func (c *Checker) checkTreeWorker(in <-chan treeJob, out chan<- TreeError, done
 	}
 }
 
-func filterTrees(backlog backend.IDs, loaderChan chan<- backend.ID, in <-chan treeJob, out chan<- treeJob, done <-chan struct{}) {
+func filterTrees(ctx context.Context, backlog backend.IDs, loaderChan chan<- backend.ID, in <-chan treeJob, out chan<- treeJob) {
 	defer func() {
 		debug.Log("checker.filterTrees", "closing output channels")
 		close(loaderChan)
@@ -434,7 +720,7 @@ func filterTrees(backlog backend.IDs, loaderChan chan<- backend.ID, in <-chan tr
 		}
 
 		select {
-		case <-done:
+		case <-ctx.Done():
 			return
 
 		case loadCh <- nextTreeID:
@@ -452,7 +738,7 @@ func filterTrees(backlog backend.IDs, loaderChan chan<- backend.ID, in <-chan tr
 			outstandingLoadTreeJobs--
 			debug.Log("checker.filterTrees", "input job tree %v", j.ID.Str())
 
-			backlog = append(backlog, j.Tree.Subtrees()...)
+			backlog = append(backlog, j.subtrees()...)
 
 			job = j
 			outCh = out
@@ -466,17 +752,53 @@ func filterTrees(backlog backend.IDs, loaderChan chan<- backend.ID, in <-chan tr
 }
 
 // Structure checks that for all snapshots all referenced data blobs and
-// subtrees are available in the index. errChan is closed after all trees have
-// been traversed.
-func (c *Checker) Structure(errChan chan<- error, done <-chan struct{}) {
+// subtrees are available in the index. errChan is closed after all trees
+// have been traversed, or ctx is cancelled.
+func (c *Checker) Structure(ctx context.Context, errChan chan<- error) {
+	c.checkStructure(ctx, nil, errChan)
+}
+
+// StructureForSnapshots works like Structure, but only checks the trees
+// reachable from the given snapshots instead of walking every snapshot in
+// the repository. This lets a caller verify just the snapshots it cares
+// about rather than paying for a full repository traversal every time.
+func (c *Checker) StructureForSnapshots(ctx context.Context, ids backend.IDs, errChan chan<- error) {
+	if ids == nil {
+		// checkStructure treats nil as "every snapshot".
+		ids = backend.IDs{}
+	}
+	c.checkStructure(ctx, ids, errChan)
+}
+
+// checkStructure does the work for Structure and StructureForSnapshots. If
+// snapshotIDs is nil, every snapshot in the repository is checked;
+// otherwise only the given ones are.
+func (c *Checker) checkStructure(ctx context.Context, snapshotIDs backend.IDs, errChan chan<- error) {
 	defer close(errChan)
 
-	trees, errs := loadSnapshotTreeIDs(c.repo)
-	debug.Log("checker.Structure", "need to check %d trees from snapshots, %d errs returned", len(trees), len(errs))
+	var (
+		trees backend.IDs
+		errs  []error
+	)
+
+	if snapshotIDs == nil {
+		trees, errs = loadSnapshotTreeIDs(ctx, c.repo)
+		debug.Log("checker.Structure", "need to check %d trees from snapshots, %d errs returned", len(trees), len(errs))
+	} else {
+		for _, id := range snapshotIDs {
+			treeID, err := loadTreeFromSnapshot(ctx, c.repo, id)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			trees = append(trees, treeID)
+		}
+		debug.Log("checker.Structure", "need to check %d trees from %d snapshots, %d errs returned", len(trees), len(snapshotIDs), len(errs))
+	}
 
 	for _, err := range errs {
 		select {
-		case <-done:
+		case <-ctx.Done():
 			return
 		case errChan <- err:
 		}
@@ -490,11 +812,11 @@ func (c *Checker) Structure(errChan chan<- error, done <-chan struct{}) {
 	var wg sync.WaitGroup
 	for i := 0; i < defaultParallelism; i++ {
 		wg.Add(2)
-		go loadTreeWorker(c.repo, treeIDChan, treeJobChan1, done, &wg)
-		go c.checkTreeWorker(treeJobChan2, treeErrChan, done, &wg)
+		go c.loadTreeWorker(ctx, treeIDChan, treeJobChan1, &wg)
+		go c.checkTreeWorker(ctx, treeJobChan2, treeErrChan, &wg)
 	}
 
-	filterTrees(trees, treeIDChan, treeJobChan1, treeJobChan2, done)
+	filterTrees(ctx, trees, treeIDChan, treeJobChan1, treeJobChan2)
 
 	wg.Wait()
 }
@@ -516,14 +838,28 @@ func (c *Checker) checkTree(id backend.ID, tree *restic.Tree) (errs []error) {
 		}
 	}
 
+	errs = append(errs, c.recordLiveBlobs(id, blobs)...)
+
+	return errs
+}
+
+// recordLiveBlobs increments the liveness refcount for every blob in blobs,
+// reporting an error for each one that isn't present in the index. It's
+// called for every tree reachable from a snapshot on every run, regardless
+// of whether the tree's own structure was re-validated by checkTree or
+// trusted from a previous run's verifiedTrees cache, since liveness must
+// always reflect the current set of snapshots.
+func (c *Checker) recordLiveBlobs(id backend.ID, blobs backend.IDs) (errs []error) {
 	for _, blobID := range blobs {
+		blobID := blobID
+
 		c.blobRefs.Lock()
 		c.blobRefs.M[blobID]++
-		debug.Log("Checker.checkTree", "blob %v refcount %d", blobID.Str(), c.blobRefs.M[blobID])
+		debug.Log("Checker.recordLiveBlobs", "blob %v refcount %d", blobID.Str(), c.blobRefs.M[blobID])
 		c.blobRefs.Unlock()
 
 		if _, ok := c.blobs[blobID]; !ok {
-			debug.Log("Checker.trees", "tree %v references blob %v which isn't contained in index", id.Str(), blobID.Str())
+			debug.Log("Checker.recordLiveBlobs", "tree %v references blob %v which isn't contained in index", id.Str(), blobID.Str())
 
 			errs = append(errs, Error{TreeID: &id, BlobID: &blobID, Err: errors.New("not found in index")})
 		}
@@ -532,6 +868,33 @@ func (c *Checker) checkTree(id backend.ID, tree *restic.Tree) (errs []error) {
 	return errs
 }
 
+// rememberVerifiedTree records that tree's structure has been fully
+// validated without error, so a future run restored via LoadState can skip
+// re-loading and re-checking it (tree IDs are content-addressed, so the
+// same ID always means the same content).
+func (c *Checker) rememberVerifiedTree(id backend.ID, tree *restic.Tree) {
+	var blobs backend.IDs
+	for _, node := range tree.Nodes {
+		if node.Type == "file" {
+			blobs = append(blobs, node.Content...)
+		}
+	}
+
+	c.verifiedTrees.Lock()
+	c.verifiedTrees.M[id] = treeContents{Blobs: blobs, Subtrees: tree.Subtrees()}
+	c.verifiedTrees.Unlock()
+}
+
+// cachedTree returns the recorded contents of a previously-verified tree, if
+// any.
+func (c *Checker) cachedTree(id backend.ID) (treeContents, bool) {
+	c.verifiedTrees.Lock()
+	defer c.verifiedTrees.Unlock()
+
+	contents, ok := c.verifiedTrees.M[id]
+	return contents, ok
+}
+
 // UnusedBlobs returns all blobs that have never been referenced.
 func (c *Checker) UnusedBlobs() (blobs backend.IDs) {
 	c.blobRefs.Lock()
@@ -0,0 +1,148 @@
+package checker
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Progress describes how far a Checker.Run invocation has gotten. It's sent
+// periodically over the channel Run returns so a caller can render a
+// progress bar or estimate how much longer the check will take.
+type Progress struct {
+	TreesChecked  uint64 `json:"trees_checked"`
+	PacksChecked  uint64 `json:"packs_checked"`
+	PacksTotal    uint64 `json:"packs_total"`
+	BlobsVerified uint64 `json:"blobs_verified"`
+	BytesRead     uint64 `json:"bytes_read"`
+
+	// ETA is always zero: Run does not compute an estimate.
+	ETA time.Duration `json:"eta"`
+}
+
+// Event is sent over the channel returned by Checker.Run. Exactly one of
+// Error and Progress is set.
+type Event struct {
+	Error    error
+	Progress *Progress
+}
+
+// MarshalJSON implements json.Marshaler so that a caller can stream Events
+// to e.g. a `restic check --json` consumer. The error, if any, is marshaled
+// using its own MarshalJSON method, which identifies the kind of error
+// (pack, tree, ...) it represents. An error that doesn't implement
+// json.Marshaler itself (e.g. one from errors.New or fmt.Errorf that slipped
+// through unwrapped) falls back to a plain {"type":"error","message":"..."}
+// instead of silently encoding as {}.
+func (e Event) MarshalJSON() ([]byte, error) {
+	if e.Progress != nil {
+		return json.Marshal(struct {
+			MessageType string `json:"message_type"`
+			*Progress
+		}{"progress", e.Progress})
+	}
+
+	var jsonErr interface{} = e.Error
+	if _, ok := e.Error.(json.Marshaler); !ok {
+		jsonErr = genericError{Type: "error", Message: e.Error.Error()}
+	}
+
+	return json.Marshal(struct {
+		MessageType string      `json:"message_type"`
+		Error       interface{} `json:"error"`
+	}{"error", jsonErr})
+}
+
+// genericError is the JSON fallback for an error value that doesn't
+// implement json.Marshaler itself.
+type genericError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e PackError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type     string `json:"type"`
+		PackID   string `json:"pack_id"`
+		Orphaned bool   `json:"orphaned,omitempty"`
+		Message  string `json:"message"`
+	}{
+		Type:     "pack",
+		PackID:   e.ID.String(),
+		Orphaned: e.Orphaned,
+		Message:  e.Err.Error(),
+	})
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e ContentError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type    string `json:"type"`
+		PackID  string `json:"pack_id"`
+		BlobID  string `json:"blob_id"`
+		Message string `json:"message"`
+	}{
+		Type:    "content",
+		PackID:  e.PackID.String(),
+		BlobID:  e.BlobID.String(),
+		Message: e.Err.Error(),
+	})
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e TreeError) MarshalJSON() ([]byte, error) {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+
+	return json.Marshal(struct {
+		Type    string   `json:"type"`
+		TreeID  string   `json:"tree_id"`
+		Errors  []string `json:"errors"`
+		Message string   `json:"message"`
+	}{
+		Type:    "tree",
+		TreeID:  e.ID.String(),
+		Errors:  messages,
+		Message: e.Error(),
+	})
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e SnapshotError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type       string `json:"type"`
+		SnapshotID string `json:"snapshot_id"`
+		Message    string `json:"message"`
+	}{
+		Type:       "snapshot",
+		SnapshotID: e.ID.String(),
+		Message:    e.Err.Error(),
+	})
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e Error) MarshalJSON() ([]byte, error) {
+	data := struct {
+		Type    string  `json:"type"`
+		TreeID  *string `json:"tree_id,omitempty"`
+		BlobID  *string `json:"blob_id,omitempty"`
+		Message string  `json:"message"`
+	}{
+		Type:    "error",
+		Message: e.Err.Error(),
+	}
+
+	if e.TreeID != nil {
+		s := e.TreeID.String()
+		data.TreeID = &s
+	}
+
+	if e.BlobID != nil {
+		s := e.BlobID.String()
+		data.BlobID = &s
+	}
+
+	return json.Marshal(data)
+}
@@ -0,0 +1,127 @@
+package checker_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/restic/restic/backend"
+	"github.com/restic/restic/checker"
+)
+
+func TestEventMarshalJSON(t *testing.T) {
+	packID := backend.ID{}
+	ev := checker.Event{Error: checker.PackError{ID: packID, Err: errors.New("test error")}}
+
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		MessageType string `json:"message_type"`
+		Error       struct {
+			Type    string `json:"type"`
+			PackID  string `json:"pack_id"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.MessageType != "error" {
+		t.Fatalf("wrong message_type: %q", decoded.MessageType)
+	}
+	if decoded.Error.Type != "pack" {
+		t.Fatalf("wrong error type: %q", decoded.Error.Type)
+	}
+	if decoded.Error.PackID != packID.String() {
+		t.Fatalf("wrong pack_id: %q", decoded.Error.PackID)
+	}
+	if decoded.Error.Message != "test error" {
+		t.Fatalf("wrong message: %q", decoded.Error.Message)
+	}
+}
+
+func TestEventMarshalJSONRawError(t *testing.T) {
+	ev := checker.Event{Error: errors.New("boom")}
+
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		MessageType string `json:"message_type"`
+		Error       struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Error.Message != "boom" {
+		t.Fatalf("raw error's message was dropped, got %q (full event: %s)", decoded.Error.Message, buf)
+	}
+}
+
+func TestSnapshotErrorMarshalJSON(t *testing.T) {
+	id := backend.ID{}
+	serr := checker.SnapshotError{ID: id, Err: errors.New("snapshot has no tree")}
+
+	buf, err := json.Marshal(serr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		Type       string `json:"type"`
+		SnapshotID string `json:"snapshot_id"`
+		Message    string `json:"message"`
+	}
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Type != "snapshot" {
+		t.Fatalf("wrong type: %q", decoded.Type)
+	}
+	if decoded.Message != "snapshot has no tree" {
+		t.Fatalf("wrong message: %q", decoded.Message)
+	}
+}
+
+func TestTreeErrorMarshalJSON(t *testing.T) {
+	treeID := backend.ID{}
+	blobID := backend.ID{}
+	terr := checker.TreeError{
+		ID: treeID,
+		Errors: []error{
+			checker.Error{TreeID: &treeID, BlobID: &blobID, Err: errors.New("not found in index")},
+		},
+	}
+
+	buf, err := json.Marshal(terr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		Type   string   `json:"type"`
+		TreeID string   `json:"tree_id"`
+		Errors []string `json:"errors"`
+	}
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Type != "tree" {
+		t.Fatalf("wrong type: %q", decoded.Type)
+	}
+	if len(decoded.Errors) != 1 {
+		t.Fatalf("expected 1 error, got %d", len(decoded.Errors))
+	}
+}
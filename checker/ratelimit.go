@@ -0,0 +1,95 @@
+package checker
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by every reader that draws from it,
+// so that the combined throughput of however many readers are using it at
+// once is capped at bytesPerSecond, rather than each reader getting its own
+// bytesPerSecond allowance.
+type rateLimiter struct {
+	mu             sync.Mutex
+	bytesPerSecond int64
+	available      int64
+	last           time.Time
+}
+
+// newRateLimiter returns a limiter capping combined throughput at
+// bytesPerSecond. A bytesPerSecond <= 0 returns nil, meaning unlimited.
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		bytesPerSecond: bytesPerSecond,
+		available:      bytesPerSecond,
+		last:           time.Now(),
+	}
+}
+
+// take blocks until at least one byte of budget is available and returns how
+// many of the requested n bytes the caller may read now; it never returns
+// more than bytesPerSecond, even if n is larger.
+func (l *rateLimiter) take(n int64) int64 {
+	if n > l.bytesPerSecond {
+		n = l.bytesPerSecond
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		now := time.Now()
+		l.available += int64(now.Sub(l.last)) * l.bytesPerSecond / int64(time.Second)
+		if l.available > l.bytesPerSecond {
+			l.available = l.bytesPerSecond
+		}
+		l.last = now
+
+		if l.available > 0 {
+			break
+		}
+
+		wait := time.Second / time.Duration(l.bytesPerSecond)
+		l.mu.Unlock()
+		time.Sleep(wait)
+		l.mu.Lock()
+	}
+
+	if n > l.available {
+		n = l.available
+	}
+	l.available -= n
+
+	return n
+}
+
+// rateLimitedReader throttles reads against a shared rateLimiter, so that
+// every rateLimitedReader drawing from the same limiter is capped together
+// rather than individually.
+type rateLimitedReader struct {
+	io.Reader
+	limiter *rateLimiter
+}
+
+// newRateLimitedReader wraps r so that reads from it draw from limiter. A
+// nil limiter means unlimited, and r is returned unwrapped.
+func newRateLimitedReader(r io.Reader, limiter *rateLimiter) io.Reader {
+	if limiter == nil {
+		return r
+	}
+
+	return &rateLimitedReader{Reader: r, limiter: limiter}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if n := r.limiter.take(int64(len(p))); n < int64(len(p)) {
+		p = p[:n]
+	}
+
+	return r.Reader.Read(p)
+}
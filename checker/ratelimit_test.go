@@ -0,0 +1,55 @@
+package checker
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRateLimiterSharedAcrossReaders verifies that several readers drawing
+// from the same limiter are capped together: their combined consumption over
+// a 200ms window shouldn't exceed what one shared bucket can yield in that
+// window by more than a single reader's worth of slack, regardless of how
+// many readers there are.
+func TestRateLimiterSharedAcrossReaders(t *testing.T) {
+	const bytesPerSecond = 1000
+	const numReaders = 10
+
+	limiter := newRateLimiter(bytesPerSecond)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var total int64
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+
+	for i := 0; i < numReaders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				n := limiter.take(100)
+				mu.Lock()
+				total += n
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// Over 200ms at 1000 B/s the bucket can yield at most its capacity
+	// (1000) plus what trickles in during the window (~200), no matter how
+	// many readers are pulling from it concurrently; the bound allows one
+	// reader's 100-byte request on top of that as slack.
+	const maxExpected = bytesPerSecond + bytesPerSecond*3/10
+	if total > maxExpected {
+		t.Errorf("readers drew %d bytes combined, want at most %d (bytesPerSecond shared, not per-reader)", total, maxExpected)
+	}
+}
+
+func TestNewRateLimiterUnlimited(t *testing.T) {
+	if l := newRateLimiter(0); l != nil {
+		t.Errorf("expected nil limiter for bytesPerSecond <= 0, got %+v", l)
+	}
+}
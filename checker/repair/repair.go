@@ -0,0 +1,284 @@
+// Package repair contains operations that act on the findings of a
+// checker.Checker run: removing packs that aren't referenced by any index,
+// rebuilding the index from the pack files actually present in the backend,
+// and pruning packs to drop blobs that are no longer referenced by any
+// snapshot.
+package repair
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/restic/restic/backend"
+	"github.com/restic/restic/debug"
+	"github.com/restic/restic/lock"
+	"github.com/restic/restic/pack"
+	"github.com/restic/restic/repository"
+)
+
+// Progress reports on-going status for a long-running repair operation so a
+// caller (e.g. the restic CLI) can display bytes reclaimed and packs
+// rewritten while the operation is still running.
+type Progress struct {
+	PacksRewritten int
+	PacksRemoved   int
+	BytesReclaimed uint64
+}
+
+// RemoveOrphanedPacks deletes the packs with the given IDs from repo. Pass
+// it the result of checker.Checker.OrphanedPacks() once the caller is sure
+// those packs really aren't referenced by any index. If progress is
+// non-nil, RemoveOrphanedPacks sends one update per removed pack and closes
+// the channel before returning.
+func RemoveOrphanedPacks(ctx context.Context, repo *repository.Repository, ids backend.IDs, progress chan<- Progress) error {
+	if progress != nil {
+		defer close(progress)
+	}
+
+	var stats Progress
+
+	for _, id := range ids {
+		debug.Log("repair.RemoveOrphanedPacks", "removing orphaned pack %v", id.Str())
+
+		if err := repo.Backend().Remove(ctx, backend.Data, id.String()); err != nil {
+			return fmt.Errorf("remove pack %v: %v", id.Str(), err)
+		}
+
+		stats.PacksRemoved++
+
+		if progress != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case progress <- stats:
+			}
+		}
+	}
+
+	return nil
+}
+
+// RebuildIndex removes all index files from the repository and rebuilds
+// them from the pack files actually present in the backend. Use this when
+// checker.Checker.LoadIndex() reports an inconsistent or old-format index
+// that can't simply be converted. Unlike Prune, it can't take a shortcut
+// from an already-loaded index: its entire purpose is to distrust whatever
+// index exists and rebuild one from what's actually stored, so every pack
+// still has to be fetched and its own header parsed.
+func RebuildIndex(ctx context.Context, repo *repository.Repository) error {
+	debug.Log("repair.RebuildIndex", "removing old indexes")
+	for id := range repo.List(ctx, backend.Index) {
+		if err := repo.Backend().Remove(ctx, backend.Index, id.String()); err != nil {
+			return fmt.Errorf("remove index %v: %v", id.Str(), err)
+		}
+	}
+
+	idx := repository.NewIndex()
+
+	debug.Log("repair.RebuildIndex", "rebuilding index from pack files")
+	for packID := range repo.List(ctx, backend.Data) {
+		entries, err := readPackHeader(ctx, repo, packID)
+		if err != nil {
+			return fmt.Errorf("list pack %v: %v", packID.Str(), err)
+		}
+
+		for _, entry := range entries {
+			idx.Store(repository.PackedBlob{
+				ID:     entry.ID,
+				Type:   entry.Type,
+				Offset: entry.Offset,
+				Length: entry.Length,
+				PackID: packID,
+			})
+		}
+	}
+
+	if _, err := repository.SaveIndex(ctx, repo, idx); err != nil {
+		return fmt.Errorf("save new index: %v", err)
+	}
+
+	return nil
+}
+
+// Prune rewrites every pack in repo's already-loaded index that holds a blob
+// for which keep returns false, dropping those blobs, and replaces the index
+// files with one index describing the kept and rewritten packs. Deciding which packs need
+// rewriting is done entirely from the in-memory index; a pack's contents are
+// only downloaded once that decision says it actually needs rewriting.
+// Packs present in the backend but absent from the index aren't touched
+// here — use checker.Checker.OrphanedPacks and RemoveOrphanedPacks for
+// those. It takes an exclusive lock on repo for the duration of the
+// operation. If progress is non-nil, Prune sends one update per rewritten
+// pack and closes the channel before returning.
+func Prune(ctx context.Context, repo *repository.Repository, keep func(id backend.ID) bool, progress chan<- Progress) error {
+	if progress != nil {
+		defer close(progress)
+	}
+
+	excl, err := lock.NewExclusiveLock(ctx, repo)
+	if err != nil {
+		return fmt.Errorf("unable to lock repository: %v", err)
+	}
+	defer excl.Unlock()
+
+	packEntries := entriesByPack(repo.Index(), ctx.Done())
+
+	newIdx := repository.NewIndex()
+	var stats Progress
+
+	for packID, entries := range packEntries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var kept, dropped int
+		for _, entry := range entries {
+			if keep(entry.ID) {
+				kept++
+			} else {
+				dropped++
+			}
+		}
+
+		if dropped == 0 {
+			for _, entry := range entries {
+				newIdx.Store(repository.PackedBlob{
+					ID: entry.ID, Type: entry.Type,
+					Offset: entry.Offset, Length: entry.Length,
+					PackID: packID,
+				})
+			}
+			continue
+		}
+
+		debug.Log("repair.Prune", "pack %v: keeping %d of %d blobs", packID.Str(), kept, kept+dropped)
+
+		// Only now, with a pack confirmed to need rewriting, do we pay for
+		// downloading it; entries themselves came from the index above.
+		buf, _, err := readPack(ctx, repo, packID)
+		if err != nil {
+			return fmt.Errorf("read pack %v: %v", packID.Str(), err)
+		}
+
+		newPackID, reclaimed, err := rewritePack(ctx, repo, buf, entries, keep, newIdx)
+		if err != nil {
+			return fmt.Errorf("rewrite pack %v: %v", packID.Str(), err)
+		}
+
+		if err := repo.Backend().Remove(ctx, backend.Data, packID.String()); err != nil {
+			return fmt.Errorf("remove old pack %v: %v", packID.Str(), err)
+		}
+
+		stats.PacksRewritten++
+		stats.BytesReclaimed += reclaimed
+
+		if progress != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case progress <- stats:
+			}
+		}
+
+		debug.Log("repair.Prune", "pack %v replaced by %v, %d bytes reclaimed", packID.Str(), newPackID.Str(), reclaimed)
+	}
+
+	var oldIndexes backend.IDs
+	for id := range repo.List(ctx, backend.Index) {
+		oldIndexes = append(oldIndexes, id)
+	}
+
+	if _, err := repository.SaveIndex(ctx, repo, newIdx); err != nil {
+		return fmt.Errorf("save new index: %v", err)
+	}
+
+	for _, id := range oldIndexes {
+		if err := repo.Backend().Remove(ctx, backend.Index, id.String()); err != nil {
+			return fmt.Errorf("remove old index %v: %v", id.Str(), err)
+		}
+	}
+
+	debug.Log("repair.Prune", "done: %d packs rewritten, %d bytes reclaimed", stats.PacksRewritten, stats.BytesReclaimed)
+
+	return nil
+}
+
+// entriesByPack groups idx's blob entries by the pack each one lives in, so
+// Prune can decide what needs rewriting without downloading anything.
+func entriesByPack(idx *repository.Index, done <-chan struct{}) map[backend.ID][]pack.Blob {
+	packEntries := make(map[backend.ID][]pack.Blob)
+	for blob := range idx.Each(done) {
+		packEntries[blob.PackID] = append(packEntries[blob.PackID], pack.Blob{
+			ID: blob.ID, Type: blob.Type, Offset: blob.Offset, Length: blob.Length,
+		})
+	}
+
+	return packEntries
+}
+
+// readPack downloads the pack with the given ID and returns its raw bytes
+// together with the list of blob entries recorded in its own header.
+func readPack(ctx context.Context, repo *repository.Repository, id backend.ID) ([]byte, []pack.Blob, error) {
+	rd, err := repo.Backend().Get(ctx, backend.Data, id.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rd.Close()
+
+	buf, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries, err := pack.List(repo.Key(), bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return buf, entries, nil
+}
+
+// readPackHeader downloads the pack with the given ID and returns its list
+// of blob entries as recorded in its own header.
+func readPackHeader(ctx context.Context, repo *repository.Repository, id backend.ID) ([]pack.Blob, error) {
+	_, entries, err := readPack(ctx, repo, id)
+	return entries, err
+}
+
+// rewritePack writes a new pack containing only the blobs for which keep
+// returns true, records them in newIdx and returns the new pack's ID and
+// the number of bytes reclaimed by dropping the other blobs. buf is the
+// pack's raw (already downloaded) content, as returned by readPack.
+func rewritePack(ctx context.Context, repo *repository.Repository, buf []byte, entries []pack.Blob, keep func(backend.ID) bool, newIdx *repository.Index) (backend.ID, uint64, error) {
+	w := repo.NewPackWriter()
+
+	var reclaimed uint64
+	for _, entry := range entries {
+		if !keep(entry.ID) {
+			reclaimed += uint64(entry.Length)
+			continue
+		}
+
+		ciphertext := buf[entry.Offset : entry.Offset+entry.Length]
+
+		offset, err := w.Add(entry.Type, entry.ID, ciphertext)
+		if err != nil {
+			return backend.ID{}, 0, err
+		}
+
+		newIdx.Store(repository.PackedBlob{
+			ID: entry.ID, Type: entry.Type,
+			Offset: offset, Length: entry.Length,
+			PackID: w.ID(),
+		})
+	}
+
+	newID, err := w.Finalize()
+	if err != nil {
+		return backend.ID{}, 0, err
+	}
+
+	return newID, reclaimed, nil
+}
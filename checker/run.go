@@ -0,0 +1,135 @@
+package checker
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RunOptions selects which checks Checker.Run performs and how.
+type RunOptions struct {
+	// CheckData enables the pack content verification done by ReadData, in
+	// addition to the cheap structural checks done by Structure and Packs.
+	// This is much more expensive, so it defaults to off.
+	CheckData bool
+
+	// ReadDataWorkers limits how many packs ReadData downloads and
+	// decrypts concurrently. 0 uses the Checker's default.
+	ReadDataWorkers int
+
+	// ProgressInterval is how often a Progress event is sent. 0 selects a
+	// sensible default.
+	ProgressInterval time.Duration
+}
+
+// Run performs the checks selected by opts and streams the errors found,
+// interleaved with periodic Progress events, over the returned channel. The
+// channel is closed once every check has finished or ctx is cancelled. This
+// replaces having to wire up Structure, Packs and ReadData by hand with
+// their own goroutines and done channels.
+func (c *Checker) Run(ctx context.Context, opts RunOptions) <-chan Event {
+	out := make(chan Event)
+
+	go func() {
+		defer close(out)
+
+		send := func(ev Event) bool {
+			select {
+			case out <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		interval := opts.ProgressInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		stopProgress := make(chan struct{})
+		var progressWG sync.WaitGroup
+		progressWG.Add(1)
+		go func() {
+			defer progressWG.Done()
+			for {
+				select {
+				case <-ticker.C:
+					if !send(Event{Progress: c.currentProgress()}) {
+						return
+					}
+				case <-stopProgress:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		if c.runChecks(ctx, opts, send) {
+			close(stopProgress)
+			send(Event{Progress: c.currentProgress()})
+		} else {
+			close(stopProgress)
+		}
+
+		progressWG.Wait()
+	}()
+
+	return out
+}
+
+// runChecks runs Structure, Packs and (if requested) ReadData in turn,
+// forwarding every error to send. It returns false if send reported that
+// the caller went away (ctx was cancelled) so Run can stop early.
+func (c *Checker) runChecks(ctx context.Context, opts RunOptions, send func(Event) bool) bool {
+	if opts.ReadDataWorkers > 0 {
+		c.SetReadDataWorkers(opts.ReadDataWorkers)
+	}
+
+	structErrChan := make(chan error)
+	go c.Structure(ctx, structErrChan)
+	for err := range structErrChan {
+		if !send(Event{Error: err}) {
+			return false
+		}
+	}
+
+	packErrChan := make(chan error)
+	go c.Packs(ctx, packErrChan)
+	for err := range packErrChan {
+		if !send(Event{Error: err}) {
+			return false
+		}
+	}
+
+	if opts.CheckData {
+		dataErrChan := make(chan error)
+		go c.ReadData(ctx, dataErrChan)
+		for err := range dataErrChan {
+			if !send(Event{Error: err}) {
+				return false
+			}
+		}
+	}
+
+	return ctx.Err() == nil
+}
+
+// currentProgress takes a snapshot of the atomic counters updated by the
+// various check workers.
+func (c *Checker) currentProgress() *Progress {
+	p := &Progress{
+		TreesChecked:  atomic.LoadUint64(&c.progress.treesChecked),
+		PacksChecked:  atomic.LoadUint64(&c.progress.packsChecked),
+		PacksTotal:    uint64(len(c.packs)),
+		BlobsVerified: atomic.LoadUint64(&c.progress.blobsVerified),
+		BytesRead:     atomic.LoadUint64(&c.progress.bytesRead),
+	}
+
+	return p
+}
@@ -0,0 +1,148 @@
+package checker
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/restic/restic/backend"
+)
+
+// treeContentsState is the on-disk representation of a verified tree's
+// contents.
+type treeContentsState struct {
+	Blobs    []string `json:"blobs"`
+	Subtrees []string `json:"subtrees"`
+}
+
+// checkerState is the on-disk representation of the dedup state saved by
+// SaveState and restored by LoadState.
+//
+// It intentionally does not include blobRefs: those counts are liveness
+// refcounts recomputed from the repository's current set of snapshots on
+// every run, and must never be carried over from a previous run, or a
+// snapshot forgotten since SaveState ran would keep its blobs looking live
+// forever, and repair.Prune would never be able to reclaim them.
+type checkerState struct {
+	VerifiedPacks []string                     `json:"verified_packs"`
+	VerifiedTrees map[string]treeContentsState `json:"verified_trees"`
+}
+
+// SaveState writes the Checker's dedup state to w: the packs ReadData has
+// already verified without error, and the trees whose structure Structure
+// has already validated without error. A later run can load this state with
+// LoadState to skip re-verifying data that's already known-good, turning
+// repeated checks of a large, mostly-unchanged repository from an O(repo)
+// operation into an O(new-data) one. Liveness (which blobs and packs are
+// still referenced by a snapshot) is always recomputed from scratch and
+// never saved.
+func (c *Checker) SaveState(w io.Writer) error {
+	c.verifiedPacks.Lock()
+	packs := make([]string, 0, len(c.verifiedPacks.M))
+	for id := range c.verifiedPacks.M {
+		packs = append(packs, id.String())
+	}
+	c.verifiedPacks.Unlock()
+
+	c.verifiedTrees.Lock()
+	trees := make(map[string]treeContentsState, len(c.verifiedTrees.M))
+	for id, contents := range c.verifiedTrees.M {
+		trees[id.String()] = treeContentsState{
+			Blobs:    idStrings(contents.Blobs),
+			Subtrees: idStrings(contents.Subtrees),
+		}
+	}
+	c.verifiedTrees.Unlock()
+
+	return json.NewEncoder(w).Encode(checkerState{VerifiedPacks: packs, VerifiedTrees: trees})
+}
+
+// LoadState restores dedup state previously written by SaveState. Call it
+// after LoadIndex and before Structure/ReadData; entries for packs or trees
+// that are no longer in the index (because the repository changed since
+// SaveState ran) are ignored. It never touches liveness refcounts; those are
+// always computed fresh from the current set of snapshots.
+func (c *Checker) LoadState(r io.Reader) error {
+	var state checkerState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+
+	c.verifiedPacks.Lock()
+	for _, str := range state.VerifiedPacks {
+		id, err := backend.ParseID(str)
+		if err != nil {
+			c.verifiedPacks.Unlock()
+			return err
+		}
+
+		if _, ok := c.packs[id]; ok {
+			c.verifiedPacks.M[id] = struct{}{}
+		}
+	}
+	c.verifiedPacks.Unlock()
+
+	c.verifiedTrees.Lock()
+	for str, contents := range state.VerifiedTrees {
+		id, err := backend.ParseID(str)
+		if err != nil {
+			c.verifiedTrees.Unlock()
+			return err
+		}
+
+		blobs, err := parseIDList(contents.Blobs)
+		if err != nil {
+			c.verifiedTrees.Unlock()
+			return err
+		}
+
+		subtrees, err := parseIDList(contents.Subtrees)
+		if err != nil {
+			c.verifiedTrees.Unlock()
+			return err
+		}
+
+		if _, ok := c.blobs[id]; !ok {
+			// The tree itself is gone from the current index (e.g. a buggy
+			// prune or backend corruption removed it); don't trust a cached
+			// verification of it, so the uncached path re-validates it.
+			continue
+		}
+
+		allKnown := true
+		for _, blobID := range blobs {
+			if _, ok := c.blobs[blobID]; !ok {
+				allKnown = false
+				break
+			}
+		}
+
+		if allKnown {
+			c.verifiedTrees.M[id] = treeContents{Blobs: blobs, Subtrees: subtrees}
+		}
+	}
+	c.verifiedTrees.Unlock()
+
+	return nil
+}
+
+func idStrings(ids backend.IDs) []string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+
+	return strs
+}
+
+func parseIDList(strs []string) (backend.IDs, error) {
+	ids := make(backend.IDs, 0, len(strs))
+	for _, str := range strs {
+		id, err := backend.ParseID(str)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,109 @@
+package checker
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/restic/restic/backend"
+	. "github.com/restic/restic/test"
+)
+
+func TestSaveLoadStateRoundTrip(t *testing.T) {
+	packID := ParseID("f41c2089a9d58a4b0bf39369fa37588e6578c928aea8e90a4490a6315b9905c1")
+	treeID := ParseID("04fdf6119abd8da279e5c25b0492704d1676043dc2cba1d4f8d40a260d61da65")
+	blobID := ParseID("db5ac30c70aaba7fef03db6be91e8d9438e1a417f759f417237efa3482e1f22b")
+
+	c := New(nil)
+	c.blobs[blobID] = struct{}{}
+	c.blobs[treeID] = struct{}{}
+	c.verifiedPacks.M[packID] = struct{}{}
+	c.packs[packID] = []backend.ID{blobID}
+	c.verifiedTrees.M[treeID] = treeContents{Blobs: backend.IDs{blobID}}
+
+	// A run's liveness refcounts must never be persisted: pretend this run
+	// found the blob and tree referenced by a snapshot.
+	c.blobRefs.M[blobID] = 1
+	c.blobRefs.M[treeID] = 1
+
+	var buf bytes.Buffer
+	if err := c.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later run starts with LoadIndex building blobs/packs fresh, and
+	// blobRefs always starts empty via New.
+	c2 := New(nil)
+	c2.blobs[blobID] = struct{}{}
+	c2.blobs[treeID] = struct{}{}
+	c2.packs[packID] = []backend.ID{blobID}
+
+	if err := c2.LoadState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c2.verifiedPacks.M[packID]; !ok {
+		t.Errorf("expected pack %v to be restored as verified", packID.Str())
+	}
+
+	if _, ok := c2.verifiedTrees.M[treeID]; !ok {
+		t.Errorf("expected tree %v to be restored from cache", treeID.Str())
+	}
+
+	if len(c2.blobRefs.M) != 0 {
+		t.Errorf("LoadState must not populate liveness refcounts, got %v", c2.blobRefs.M)
+	}
+}
+
+func TestLoadStateDropsTreesWithUnknownBlobs(t *testing.T) {
+	treeID := ParseID("356493f0b00a614d36c698591bbb2b1d801932d85328c1f508019550034549fc")
+	blobID := ParseID("08d0444e9987fa6e35ce4232b2b71473e1a8f66b2f9664cc44dc57aad3c5a63a")
+
+	c := New(nil)
+	c.verifiedTrees.M[treeID] = treeContents{Blobs: backend.IDs{blobID}}
+
+	var buf bytes.Buffer
+	if err := c.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The repository changed since SaveState ran: blobID is no longer in
+	// the current index, while the tree itself still is.
+	c2 := New(nil)
+	c2.blobs[treeID] = struct{}{}
+	if err := c2.LoadState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c2.verifiedTrees.M[treeID]; ok {
+		t.Errorf("expected tree %v to be dropped, its blob is no longer in the index", treeID.Str())
+	}
+}
+
+func TestLoadStateDropsTreeMissingFromIndex(t *testing.T) {
+	treeID := ParseID("b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c")
+	blobID := ParseID("5249af22d3b2acd6da8048ac37b2a87fa346fabde55ed23bb866f7618843c9fe")
+
+	c := New(nil)
+	c.blobs[blobID] = struct{}{}
+	c.blobs[treeID] = struct{}{}
+	c.verifiedTrees.M[treeID] = treeContents{Blobs: backend.IDs{blobID}}
+
+	var buf bytes.Buffer
+	if err := c.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tree itself (not just one of its blobs) has vanished from the
+	// current index, e.g. a buggy prune or backend corruption removed it.
+	// A cached "verified" entry must not survive that even though its
+	// recorded blobs all still check out.
+	c2 := New(nil)
+	c2.blobs[blobID] = struct{}{}
+	if err := c2.LoadState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c2.verifiedTrees.M[treeID]; ok {
+		t.Errorf("expected tree %v to be dropped, it is no longer in the index", treeID.Str())
+	}
+}